@@ -0,0 +1,272 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// ProbeFunc performs one probe attempt and reports how long it took. A
+// non-nil error means the attempt failed; latency is still recorded in
+// that case and shows up in the JSON report, so a reader can tell
+// "failing fast" from "hanging".
+type ProbeFunc func() (time.Duration, error)
+
+// ProbeSample is one outcome of running a ProbeFunc, stamped with when it
+// started.
+type ProbeSample struct {
+	At      time.Time     `json:"at"`
+	Latency time.Duration `json:"latency"`
+	Err     string        `json:"err,omitempty"`
+}
+
+// ProbeStats summarizes every sample recorded for one probe over the
+// lifetime of an AsyncProbe run, and is what SLO checks are evaluated
+// against.
+type ProbeStats struct {
+	Name     string        `json:"name"`
+	Total    int           `json:"total"`
+	Failures int           `json:"failures"`
+	Samples  []ProbeSample `json:"samples"`
+}
+
+// SuccessRate returns the fraction of samples that didn't error, or 0 if
+// no samples were recorded.
+func (s *ProbeStats) SuccessRate() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Total-s.Failures) / float64(s.Total)
+}
+
+// LatencyPercentile returns the pth percentile (0-100) latency among
+// successful samples, or 0 if none succeeded.
+func (s *ProbeStats) LatencyPercentile(p float64) time.Duration {
+	var latencies []time.Duration
+	for _, sample := range s.Samples {
+		if sample.Err == "" {
+			latencies = append(latencies, sample.Latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Sort(durationSlice(latencies))
+	idx := int(p / 100 * float64(len(latencies)-1))
+	return latencies[idx]
+}
+
+// durationSlice implements sort.Interface so LatencyPercentile can sort
+// without allocating a closure-based sort.Slice for every call.
+type durationSlice []time.Duration
+
+func (d durationSlice) Len() int           { return len(d) }
+func (d durationSlice) Less(i, j int) bool { return d[i] < d[j] }
+func (d durationSlice) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// MaxGap returns the largest interval between the start of two
+// consecutive samples, or 0 if fewer than two were recorded.
+func (s *ProbeStats) MaxGap() time.Duration {
+	var max time.Duration
+	for i := 1; i < len(s.Samples); i++ {
+		if gap := s.Samples[i].At.Sub(s.Samples[i-1].At); gap > max {
+			max = gap
+		}
+	}
+	return max
+}
+
+// SLO is a user-defined assertion evaluated against one probe's
+// accumulated ProbeStats once an AsyncProbe run stops.
+type SLO struct {
+	Probe    string
+	Describe string
+	Check    func(*ProbeStats) error
+}
+
+// MinSuccessRate returns an SLO check asserting at least rate (in [0,1])
+// of a probe's samples succeeded, e.g. ">=99% of LB probes succeed".
+func MinSuccessRate(rate float64) func(*ProbeStats) error {
+	return func(s *ProbeStats) error {
+		if s.Total == 0 {
+			return fmt.Errorf("no samples recorded")
+		}
+		if got := s.SuccessRate(); got < rate {
+			return fmt.Errorf("success rate %.2f%% below required %.2f%% (%d/%d failed)",
+				got*100, rate*100, s.Failures, s.Total)
+		}
+		return nil
+	}
+}
+
+// MaxLatencyPercentile returns an SLO check asserting the pth percentile
+// (0-100) of successful samples' latency is under max, e.g. "apiserver
+// p99 latency < 2s".
+func MaxLatencyPercentile(p float64, max time.Duration) func(*ProbeStats) error {
+	return func(s *ProbeStats) error {
+		if got := s.LatencyPercentile(p); got > max {
+			return fmt.Errorf("p%.0f latency %v exceeds max %v", p, got, max)
+		}
+		return nil
+	}
+}
+
+// MaxSampleGap returns an SLO check asserting no two consecutive samples
+// started more than max apart, e.g. "no gap > 5s" -- catches a probe
+// silently stalling instead of erroring.
+func MaxSampleGap(max time.Duration) func(*ProbeStats) error {
+	return func(s *ProbeStats) error {
+		if got := s.MaxGap(); got > max {
+			return fmt.Errorf("gap of %v between samples exceeds max %v", got, max)
+		}
+		return nil
+	}
+}
+
+// AsyncProbe runs a set of named ProbeFuncs concurrently on a fixed
+// interval for the duration of a disruptive operation (a master upgrade,
+// a node drain, a kill-master test, ...), records a latency/error-rate
+// time series per probe, and asserts a set of SLOs against what it
+// recorded once the operation finishes. This generalizes the single
+// ad-hoc reachability goroutine upgrade tests used to run, so an
+// availability regression shows up as a failed SLO rather than requiring
+// every single probe to succeed.
+type AsyncProbe struct {
+	interval time.Duration
+	probes   map[string]ProbeFunc
+	slos     []SLO
+
+	mu    sync.Mutex
+	stats map[string]*ProbeStats
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewAsyncProbe creates an AsyncProbe that runs each registered probe
+// roughly every interval.
+func NewAsyncProbe(interval time.Duration) *AsyncProbe {
+	return &AsyncProbe{
+		interval: interval,
+		probes:   map[string]ProbeFunc{},
+	}
+}
+
+// WithProbe registers fn to run under name. It returns a, so calls chain.
+func (a *AsyncProbe) WithProbe(name string, fn ProbeFunc) *AsyncProbe {
+	a.probes[name] = fn
+	return a
+}
+
+// WithSLO registers an assertion to evaluate against probe's stats when
+// Stop is called. describe is a human-readable label used in failure
+// messages (e.g. "load balancer reachable"). It returns a, so calls
+// chain.
+func (a *AsyncProbe) WithSLO(probe, describe string, check func(*ProbeStats) error) *AsyncProbe {
+	a.slos = append(a.slos, SLO{Probe: probe, Describe: describe, Check: check})
+	return a
+}
+
+// Start begins running every registered probe concurrently until Stop is
+// called.
+func (a *AsyncProbe) Start() {
+	a.done = make(chan struct{})
+	a.stats = make(map[string]*ProbeStats, len(a.probes))
+	for name := range a.probes {
+		a.stats[name] = &ProbeStats{Name: name}
+	}
+	for name, fn := range a.probes {
+		a.wg.Add(1)
+		go a.run(name, fn)
+	}
+}
+
+func (a *AsyncProbe) run(name string, fn ProbeFunc) {
+	defer a.wg.Done()
+	defer GinkgoRecover()
+	util.Until(func() {
+		start := time.Now()
+		latency, err := fn()
+		a.record(name, start, latency, err)
+	}, a.interval, a.done)
+}
+
+func (a *AsyncProbe) record(name string, at time.Time, latency time.Duration, err error) {
+	sample := ProbeSample{At: at, Latency: latency}
+	if err != nil {
+		sample.Err = err.Error()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := a.stats[name]
+	stats.Total++
+	if err != nil {
+		stats.Failures++
+	}
+	stats.Samples = append(stats.Samples, sample)
+}
+
+// Stop halts every probe, waits for in-flight checks to finish, and
+// evaluates the registered SLOs in order against what was recorded,
+// returning an error for the first one that is violated. It always
+// returns a JSON report of every probe's stats, even when an SLO is
+// violated, so a caller can log it for debugging a failure.
+func (a *AsyncProbe) Stop() (report []byte, err error) {
+	close(a.done)
+	a.wg.Wait()
+
+	report, marshalErr := json.MarshalIndent(a.statsSlice(), "", "  ")
+	if marshalErr != nil {
+		Logf("Error marshaling async probe report: %v", marshalErr)
+	}
+
+	for _, slo := range a.slos {
+		stats, ok := a.stats[slo.Probe]
+		if !ok {
+			return report, fmt.Errorf("SLO %q references unknown probe %q", slo.Describe, slo.Probe)
+		}
+		if violation := slo.Check(stats); violation != nil {
+			return report, fmt.Errorf("SLO violated for probe %q (%s): %v", slo.Probe, slo.Describe, violation)
+		}
+	}
+	return report, nil
+}
+
+func (a *AsyncProbe) statsSlice() []*ProbeStats {
+	out := make([]*ProbeStats, 0, len(a.stats))
+	for _, s := range a.stats {
+		out = append(out, s)
+	}
+	sort.Sort(byProbeName(out))
+	return out
+}
+
+// byProbeName sorts ProbeStats by name so the JSON report is stable
+// between runs.
+type byProbeName []*ProbeStats
+
+func (b byProbeName) Len() int           { return len(b) }
+func (b byProbeName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+func (b byProbeName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
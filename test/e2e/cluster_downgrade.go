@@ -0,0 +1,161 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// UpgradeDirection records which way a VersionSkewStep is moving the
+// cluster, purely for logging/naming -- ClusterUpgrader itself has no
+// notion of "up" or "down", just "get to this version".
+type UpgradeDirection string
+
+const (
+	UpgradeDirectionUp   UpgradeDirection = "up"
+	UpgradeDirectionDown UpgradeDirection = "down"
+)
+
+// VersionSkewStep describes one entry in the upgrade/downgrade matrix:
+// move the cluster from FromVersion to ToVersion, in Direction.
+type VersionSkewStep struct {
+	FromVersion string
+	ToVersion   string
+	Direction   UpgradeDirection
+}
+
+// upgradeTargetVersionsFlag drives the version-skew matrix the "version
+// skew" spec runs. It should live on testContext alongside the other
+// e2e flags, but testContext's flag registration isn't part of this
+// package, so it's registered here directly instead.
+var upgradeTargetVersionsFlag = flag.String("upgrade-target-versions", "",
+	"Comma-separated version-skew matrix for the \"version skew\" spec, e.g. "+
+		"\"1.1.0=1.2.0,1.2.0=1.1.0\" (each entry is fromVersion=toVersion; direction is "+
+		"inferred by comparing the two). Defaults to a single forward latest_ci step if unset.")
+
+// upgradeTargetVersions parses upgradeTargetVersionsFlag into the
+// version-skew matrix. It's read at spec-run time, inside the "version
+// skew" It, rather than at package init: ginkgo builds the spec tree
+// (including any per-step It()s a for-range over this would create)
+// before flag.Parse() runs, so generating one It() per step here would
+// always see the flag's zero value.
+func upgradeTargetVersions() []VersionSkewStep {
+	raw := *upgradeTargetVersionsFlag
+	if raw == "" {
+		return []VersionSkewStep{{FromVersion: version, ToVersion: version, Direction: UpgradeDirectionUp}}
+	}
+	var steps []VersionSkewStep
+	for _, entry := range strings.Split(raw, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			Failf("malformed --upgrade-target-versions entry %q; want fromVersion=toVersion", entry)
+			continue
+		}
+		from, to := parts[0], parts[1]
+		direction := UpgradeDirectionUp
+		if compareVersions(to, from) < 0 {
+			direction = UpgradeDirectionDown
+		}
+		steps = append(steps, VersionSkewStep{FromVersion: from, ToVersion: to, Direction: direction})
+	}
+	return steps
+}
+
+// compareVersions compares dot-separated numeric versions component by
+// component, returning <0, 0, or >0 as a<b, a==b, or a>b. A position
+// where either side's component isn't numeric (e.g. the "latest_ci" build
+// label) or is missing is skipped, i.e. treated as equal, since there's no
+// ordering to infer from a CI label.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		av, aNum := componentAt(as, i)
+		bv, bNum := componentAt(bs, i)
+		if !aNum || !bNum {
+			continue
+		}
+		if av != bv {
+			return av - bv
+		}
+	}
+	return 0
+}
+
+func componentAt(parts []string, i int) (int, bool) {
+	if i >= len(parts) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(parts[i])
+	return n, err == nil
+}
+
+// masterDowngrade asks upgrader to move the master to toVersion. It's the
+// master upgrade's mirror image for the version-skew matrix; the
+// ClusterUpgrader.UpgradeMaster call underneath is identical either way.
+func masterDowngrade(upgrader ClusterUpgrader, toVersion string) func() error {
+	return func() error { return upgrader.UpgradeMaster(toVersion) }
+}
+
+// nodeDowngrade asks upgrader to roll every node onto toVersion. It's
+// testClusterNodeUpgrade's mirror image for the version-skew matrix.
+func nodeDowngrade(f Framework, upgrader ClusterUpgrader, toVersion string, replicas int) error {
+	return testClusterNodeUpgrade(f, upgrader, toVersion, replicas)
+}
+
+// runVersionSkewStep drives one entry of the version-skew matrix: it
+// upgrades (or downgrades) the master to step.ToVersion, validates that
+// the cluster still works with the master ahead of (or behind) the
+// nodes -- the skew window every rolling upgrade passes through -- and
+// then either rolls the nodes to match or rolls the master back if the
+// node rollout fails.
+func runVersionSkewStep(f Framework, ip, svcName, rcName string, ingress api.LoadBalancerIngress, replicas int, upgrader ClusterUpgrader, step VersionSkewStep, dataFixture *UpgradeDataFixture) {
+	By(fmt.Sprintf("Validating cluster before %sgrading master from %s to %s", step.Direction, step.FromVersion, step.ToVersion))
+	expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+
+	By(fmt.Sprintf("Moving master from %s to %s", step.FromVersion, step.ToVersion))
+	masterOp := func() error { return upgrader.UpgradeMaster(step.ToVersion) }
+	if step.Direction == UpgradeDirectionDown {
+		masterOp = masterDowngrade(upgrader, step.ToVersion)
+	}
+	testMasterUpgrade(f, ip, svcName, masterOp)
+
+	By(fmt.Sprintf("Validating supported version skew with the master at %s and the nodes at %s", step.ToVersion, step.FromVersion))
+	expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+
+	By(fmt.Sprintf("Rolling nodes from %s to %s", step.FromVersion, step.ToVersion))
+	var nodeErr error
+	if step.Direction == UpgradeDirectionDown {
+		nodeErr = nodeDowngrade(f, upgrader, step.ToVersion, replicas)
+	} else {
+		nodeErr = testClusterNodeUpgrade(f, upgrader, step.ToVersion, replicas)
+	}
+	if nodeErr != nil {
+		By(fmt.Sprintf("Node rollout failed; rolling the master back to %s", step.FromVersion))
+		expectNoError(upgrader.UpgradeMaster(step.FromVersion))
+		Failf("node rollout from %s to %s failed: %v", step.FromVersion, step.ToVersion, nodeErr)
+	}
+
+	By("Validating cluster after the version-skew step")
+	expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+}
@@ -18,17 +18,14 @@ package e2e
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
-	"net/http"
 	"os/exec"
 	"path"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
-	"github.com/GoogleCloudPlatform/kubernetes/pkg/util"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/wait"
 
 	. "github.com/onsi/ginkgo"
@@ -38,30 +35,70 @@ import (
 // version applies to upgrades; kube-push always pushes local binaries.
 const version = "latest_ci"
 
+// UpgradeStrategy selects how a node upgrade replaces the kubelet/kube-proxy
+// running on each node. ReplaceMIGUpgrade is the original strategy: it rolls
+// each node onto a fresh GCE instance cut from a new instance template.
+// InPlaceUpgrade keeps the instance (and its identity: name, disks, IP)
+// and swaps the binaries on it directly, which is what
+// `upgrade-cluster-in-place` uses to exercise the in-place rolling-upgrade
+// code path.
+type UpgradeStrategy string
+
+const (
+	ReplaceMIGUpgrade UpgradeStrategy = "ReplaceMIG"
+	InPlaceUpgrade    UpgradeStrategy = "InPlace"
+)
+
+// The following in-place upgrade knobs mirror what a real rollout would let
+// an operator tune. There's no flag plumbing for them yet, so they're fixed
+// here rather than threaded through testContext.
+var (
+	// nodeDrainTimeout bounds how long drainNode waits for a node's pods to
+	// terminate before giving up on it (subject to ignoreDrainFailure).
+	nodeDrainTimeout = 5 * time.Minute
+	// nodeDrainGracePeriod is passed to drainNode and logged, but drainNode
+	// does not apply it: evicted pods get the default deletion grace period.
+	nodeDrainGracePeriod = 30 * time.Second
+	// ignoreDrainFailure, if true, lets the in-place upgrade proceed on a
+	// node whose pods didn't all drain within nodeDrainTimeout instead of
+	// aborting the whole upgrade.
+	ignoreDrainFailure = false
+	// inPlaceMaxUnavailable caps how many nodes are cordoned/drained/
+	// upgraded at once during an in-place rolling upgrade.
+	inPlaceMaxUnavailable = 1
+)
+
 // The following upgrade functions are passed into the framework below and used
 // to do the actual upgrades.
 
-var masterUpgrade = func() error {
-	_, _, err := runScript("hack/e2e-internal/e2e-upgrade.sh", "-M", version)
-	return err
-}
-
 var masterPush = func() error {
 	_, _, err := runScript("hack/e2e-internal/e2e-push.sh", "-m")
 	return err
 }
 
-var nodeUpgrade = func(f Framework, replicas int) error {
-	Logf("Preparing node upgarde by creating new instance template")
-	stdout, _, err := runScript("hack/e2e-internal/e2e-upgrade.sh", "-P", version)
+// testClusterNodeUpgrade drives a provider-agnostic ReplaceMIGUpgrade: it
+// has upgrader cut a node template for toVersion, rolls every node onto
+// it, then waits for nodes and pods to come back healthy. Backends differ
+// in how PrepareNodeTemplate/RollNodes actually replace instances, but the
+// surrounding wait/validate logic is the same everywhere.
+func testClusterNodeUpgrade(f Framework, upgrader ClusterUpgrader, toVersion string, replicas int) error {
+	Logf("Preparing node upgrade to %s", toVersion)
+	handle, err := upgrader.PrepareNodeTemplate(toVersion)
 	if err != nil {
 		return err
 	}
-	tmpl := strings.TrimSpace(stdout)
+	return rollNodesAndWait(f, upgrader, handle, toVersion, replicas)
+}
 
-	Logf("Performing a node upgrade to %s; waiting at most %v per node", tmpl, restartPerNodeTimeout)
-	if err := migRollingUpdate(tmpl, restartPerNodeTimeout); err != nil {
-		return fmt.Errorf("error doing node upgrade via a migRollingUpdate to %s: %v", tmpl, err)
+// rollNodesAndWait rolls every node onto the template in handle and waits
+// for nodes and pods to come back healthy. Callers that already hold a
+// handle from their own PrepareNodeTemplate/CleanupTemplate lifecycle
+// should call this directly instead of testClusterNodeUpgrade, which
+// would otherwise cut (and leak) a second, unused template.
+func rollNodesAndWait(f Framework, upgrader ClusterUpgrader, handle, toVersion string, replicas int) error {
+	Logf("Rolling nodes onto %s; waiting at most %v per node", toVersion, restartPerNodeTimeout)
+	if err := upgrader.RollNodes(handle, restartPerNodeTimeout); err != nil {
+		return fmt.Errorf("error doing node upgrade to %s: %v", toVersion, err)
 	}
 
 	Logf("Waiting up to %v for all nodes to be ready after the upgrade", restartNodeReadyAgainTimeout)
@@ -73,6 +110,159 @@ var nodeUpgrade = func(f Framework, replicas int) error {
 	return waitForPodsRunningReady(f.Namespace.Name, replicas, restartPodReadyAgainTimeout)
 }
 
+// nodeUpgradeInPlace implements InPlaceUpgrade: unlike testClusterNodeUpgrade,
+// it never swaps out the underlying instances. Nodes are handled in
+// batches of inPlaceMaxUnavailable: every node in a batch is cordoned and
+// drained, then each is upgraded via SSH and uncordoned, and all nodes
+// must be ready again before the next batch starts. This exercises the
+// rolling-upgrade code path that keeps machine identity stable.
+var nodeUpgradeInPlace = func(f Framework, replicas int) error {
+	nodes, err := f.Client.Nodes().List(labels.Everything(), nil)
+	if err != nil {
+		return fmt.Errorf("error listing nodes before in-place upgrade: %v", err)
+	}
+
+	for batchStart := 0; batchStart < len(nodes.Items); batchStart += inPlaceMaxUnavailable {
+		batch := nodes.Items[batchStart:minInt(batchStart+inPlaceMaxUnavailable, len(nodes.Items))]
+
+		for _, node := range batch {
+			Logf("Cordoning node %s ahead of in-place upgrade", node.Name)
+			if err := cordonNode(f, node.Name, true); err != nil {
+				return fmt.Errorf("error cordoning node %s: %v", node.Name, err)
+			}
+
+			Logf("Draining node %s (grace period %v, timeout %v, ignoreDrainFailure=%v)",
+				node.Name, nodeDrainGracePeriod, nodeDrainTimeout, ignoreDrainFailure)
+			if err := drainNode(f, node.Name, nodeDrainGracePeriod, nodeDrainTimeout); err != nil {
+				if !ignoreDrainFailure {
+					return fmt.Errorf("error draining node %s: %v", node.Name, err)
+				}
+				Logf("Ignoring drain failure on node %s: %v", node.Name, err)
+			}
+		}
+
+		for _, node := range batch {
+			Logf("Upgrading node %s to %s in place", node.Name, version)
+			if err := upgradeNodeInPlace(node.Name, version); err != nil {
+				return fmt.Errorf("error upgrading node %s in place: %v", node.Name, err)
+			}
+
+			Logf("Uncordoning node %s", node.Name)
+			if err := cordonNode(f, node.Name, false); err != nil {
+				return fmt.Errorf("error uncordoning node %s: %v", node.Name, err)
+			}
+		}
+
+		Logf("Waiting up to %v for nodes to be ready after upgrading a batch of %d node(s)", restartNodeReadyAgainTimeout, len(batch))
+		if _, err := checkNodesReady(f.Client, restartNodeReadyAgainTimeout, testContext.CloudConfig.NumNodes); err != nil {
+			return err
+		}
+	}
+
+	Logf("Waiting up to %v for all pods to be running and ready after the upgrade", restartPodReadyAgainTimeout)
+	return waitForPodsRunningReady(f.Namespace.Name, replicas, restartPodReadyAgainTimeout)
+}
+
+// cordonNode sets node's Unschedulable bit, which keeps the scheduler from
+// placing new pods on it while it's drained and upgraded. Passing
+// unschedulable=false reverses this once the upgrade completes.
+func cordonNode(f Framework, name string, unschedulable bool) error {
+	node, err := f.Client.Nodes().Get(name)
+	if err != nil {
+		return err
+	}
+	if node.Spec.Unschedulable == unschedulable {
+		return nil
+	}
+	node.Spec.Unschedulable = unschedulable
+	_, err = f.Client.Nodes().Update(node)
+	return err
+}
+
+// mirrorPodAnnotationKey marks a pod as the kubelet's local mirror of a
+// static pod manifest. Deleting a mirror pod through the API doesn't stop
+// it -- the kubelet just recreates it from the manifest it still has on
+// disk -- so drainNode leaves these alone rather than waiting on them
+// forever.
+const mirrorPodAnnotationKey = "kubernetes.io/config.mirror"
+
+// createdByAnnotationKey holds a JSON-serialized reference to whatever
+// controller created a pod, from before controllers used OwnerReferences.
+// drainNode uses it to recognize DaemonSet-managed pods, which the
+// DaemonSet controller recreates on the same node the moment they're
+// evicted.
+const createdByAnnotationKey = "kubernetes.io/created-by"
+
+// isDaemonSetPod reports whether pod is managed by a DaemonSet, per its
+// createdByAnnotationKey annotation.
+func isDaemonSetPod(pod *api.Pod) bool {
+	raw, ok := pod.Annotations[createdByAnnotationKey]
+	if !ok {
+		return false
+	}
+	var ref struct {
+		Reference api.ObjectReference `json:"reference"`
+	}
+	if err := json.Unmarshal([]byte(raw), &ref); err != nil {
+		return false
+	}
+	return ref.Reference.Kind == "DaemonSet"
+}
+
+// isMirrorPod reports whether pod is a kubelet-managed mirror of a static
+// pod manifest.
+func isMirrorPod(pod *api.Pod) bool {
+	_, ok := pod.Annotations[mirrorPodAnnotationKey]
+	return ok
+}
+
+// drainNode evicts every evictable pod running on name -- skipping mirror
+// pods and DaemonSet-managed pods, neither of which actually leave when
+// deleted -- and waits up to timeout for the node to empty out. gracePeriod
+// is not applied: each pod is deleted with the default grace period, and
+// no pod is force-deleted.
+func drainNode(f Framework, name string, gracePeriod, timeout time.Duration) error {
+	return wait.Poll(poll, timeout, func() (bool, error) {
+		pods, err := f.Client.Pods(api.NamespaceAll).List(labels.Everything(), nil)
+		if err != nil {
+			return false, err
+		}
+		remaining := 0
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Spec.NodeName != name {
+				continue
+			}
+			if isMirrorPod(pod) || isDaemonSetPod(pod) {
+				continue
+			}
+			remaining++
+			// TODO: pass gracePeriod through once Pods().Delete() grows a
+			// DeleteOptions parameter; for now the kubelet's default grace
+			// period applies.
+			if err := f.Client.Pods(pod.Namespace).Delete(pod.Name); err != nil {
+				Logf("Error evicting pod %s/%s from node %s: %v", pod.Namespace, pod.Name, name, err)
+			}
+		}
+		return remaining == 0, nil
+	})
+}
+
+// upgradeNodeInPlace runs the node upgrade script over SSH against name,
+// swapping its kubelet/kube-proxy binaries for toVersion without touching
+// the underlying GCE instance.
+func upgradeNodeInPlace(name, toVersion string) error {
+	_, _, err := runScript("hack/e2e-internal/e2e-upgrade.sh", "-N", name, toVersion)
+	return err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 var _ = Describe("Skipped", func() {
 	Describe("Cluster upgrade", func() {
 		svcName, replicas := "baz", 2
@@ -80,6 +270,7 @@ var _ = Describe("Skipped", func() {
 		var ingress api.LoadBalancerIngress
 		f := Framework{BaseName: "cluster-upgrade"}
 		var w *WebserverTest
+		var dataFixture *UpgradeDataFixture
 
 		BeforeEach(func() {
 			By("Setting up the service, RC, and pods")
@@ -106,13 +297,13 @@ var _ = Describe("Skipped", func() {
 			}
 			testLoadBalancerReachable(ingress, 80)
 
-			// TODO(mbforbes): Add setup, validate, and teardown for:
-			//  - secrets
-			//  - volumes
-			//  - persistent volumes
+			By("Setting up a Secret and PersistentVolumeClaim to check for data durability")
+			dataFixture = NewUpgradeDataFixture(f)
+			dataFixture.Setup()
 		})
 
 		AfterEach(func() {
+			dataFixture.Cleanup()
 			f.afterEach()
 			w.Cleanup()
 		})
@@ -120,133 +311,139 @@ var _ = Describe("Skipped", func() {
 		Describe("kube-push", func() {
 			It("of master should maintain responsive services", func() {
 				By("Validating cluster before master upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
 				By("Performing a master upgrade")
-				testMasterUpgrade(ip, masterPush)
+				testMasterUpgrade(f, ip, svcName, masterPush)
 				By("Validating cluster after master upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
 			})
 		})
 
-		Describe("gce-upgrade-master", func() {
+		Describe("upgrade-master", func() {
 			It("should maintain responsive services", func() {
-				// TODO(mbforbes): Add GKE support.
-				if !providerIs("gce") {
+				upgrader, ok := clusterUpgraderForProvider()
+				if !ok {
 					By(fmt.Sprintf("Skipping upgrade test, which is not implemented for %s", testContext.Provider))
 					return
 				}
 				By("Validating cluster before master upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
 				By("Performing a master upgrade")
-				testMasterUpgrade(ip, masterUpgrade)
+				testMasterUpgrade(f, ip, svcName, func() error { return upgrader.UpgradeMaster(version) })
 				By("Validating cluster after master upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
 			})
 		})
 
-		Describe("gce-upgrade-cluster", func() {
-			var tmplBefore, tmplAfter string
+		Describe("upgrade-cluster", func() {
+			var upgrader ClusterUpgrader
+			var handle string
+
 			BeforeEach(func() {
-				By("Getting the node template before the upgrade")
+				var ok bool
+				upgrader, ok = clusterUpgraderForProvider()
+				if !ok {
+					return
+				}
+				By("Preparing the node template for the upgrade")
 				var err error
-				tmplBefore, err = migTemplate()
+				handle, err = upgrader.PrepareNodeTemplate(version)
 				expectNoError(err)
 			})
 
 			AfterEach(func() {
-				By("Cleaning up any unused node templates")
-				var err error
-				tmplAfter, err = migTemplate()
-				if err != nil {
-					Logf("Could not get node template post-upgrade; may have leaked template %s", tmplBefore)
+				if upgrader == nil {
 					return
 				}
-				if tmplBefore == tmplAfter {
-					// The node upgrade failed so there's no need to delete
-					// anything.
-					Logf("Node template %s is still in use; not cleaning up", tmplBefore)
-					return
-				}
-				// TODO(mbforbes): Distinguish between transient failures
-				// and "cannot delete--in use" errors and retry on the
-				// former.
-				Logf("Deleting node template %s", tmplBefore)
-				o, err := exec.Command("gcloud", "compute", "instance-templates",
-					fmt.Sprintf("--project=%s", testContext.CloudConfig.ProjectID),
-					"delete",
-					tmplBefore).CombinedOutput()
-				if err != nil {
-					Logf("gcloud compute instance-templates delete %s call failed with err: %v, output: %s",
-						tmplBefore, err, string(o))
-					Logf("May have leaked %s", tmplBefore)
+				By("Cleaning up the node template")
+				if err := upgrader.CleanupTemplate(handle); err != nil {
+					Logf("Error cleaning up node template %s: %v", handle, err)
 				}
 			})
 
 			It("should maintain a functioning cluster", func() {
-				// TODO(mbforbes): Add GKE support.
-				if !providerIs("gce") {
+				if upgrader == nil {
 					By(fmt.Sprintf("Skipping upgrade test, which is not implemented for %s", testContext.Provider))
 					return
 				}
 				By("Validating cluster before master upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
 				By("Performing a master upgrade")
-				testMasterUpgrade(ip, masterUpgrade)
+				testMasterUpgrade(f, ip, svcName, func() error { return upgrader.UpgradeMaster(version) })
 				By("Validating cluster after master upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
-				By("Performing a node upgrade")
-				testNodeUpgrade(f, nodeUpgrade, replicas)
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+				By("Performing a node upgrade via ReplaceMIG")
+				testNodeUpgrade(f, ip, svcName, func(f Framework, n int) error {
+					return rollNodesAndWait(f, upgrader, handle, version, n)
+				}, replicas)
 				By("Validating cluster after node upgrade")
-				expectNoError(validate(f, svcName, rcName, ingress, replicas))
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+			})
+		})
+
+		Describe("upgrade-cluster-in-place", func() {
+			It("should maintain a functioning cluster", func() {
+				upgrader, ok := clusterUpgraderForProvider()
+				if !ok || !upgrader.SupportsInPlace() {
+					By(fmt.Sprintf("Skipping in-place upgrade test, which is not implemented for %s", testContext.Provider))
+					return
+				}
+				By("Validating cluster before master upgrade")
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+				By("Performing a master upgrade")
+				testMasterUpgrade(f, ip, svcName, func() error { return upgrader.UpgradeMaster(version) })
+				By("Validating cluster after master upgrade")
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+				By("Performing a node upgrade in place")
+				testNodeUpgrade(f, ip, svcName, nodeUpgradeInPlace, replicas)
+				By("Validating cluster after node upgrade")
+				expectNoError(validate(f, svcName, rcName, ingress, replicas, dataFixture))
+			})
+		})
+
+		Describe("version skew", func() {
+			It("should support the --upgrade-target-versions matrix", func() {
+				upgrader, ok := clusterUpgraderForProvider()
+				if !ok {
+					By(fmt.Sprintf("Skipping version-skew test, which is not implemented for %s", testContext.Provider))
+					return
+				}
+				for _, step := range upgradeTargetVersions() {
+					By(fmt.Sprintf("Running version-skew step: %sgrade from %s to %s", step.Direction, step.FromVersion, step.ToVersion))
+					runVersionSkewStep(f, ip, svcName, rcName, ingress, replicas, upgrader, step, dataFixture)
+				}
 			})
 		})
 	})
 })
 
-func testMasterUpgrade(ip string, mUp func() error) {
+func testMasterUpgrade(f Framework, ip, svcName string, mUp func() error) {
 	Logf("Starting async validation")
-	httpClient := http.Client{Timeout: 2 * time.Second}
-	done := make(chan struct{}, 1)
-	// Let's make sure we've finished the heartbeat before shutting things down.
-	var wg sync.WaitGroup
-	go util.Until(func() {
-		defer GinkgoRecover()
-		wg.Add(1)
-		defer wg.Done()
-
-		if err := wait.Poll(poll, singleCallTimeout, func() (bool, error) {
-			r, err := httpClient.Get("http://" + ip)
-			if err != nil {
-				Logf("Error reaching %s: %v", ip, err)
-				return false, nil
-			}
-			if r.StatusCode < http.StatusOK || r.StatusCode >= http.StatusNotFound {
-				Logf("Bad response; status: %d, response: %v", r.StatusCode, r)
-				return false, nil
-			}
-			return true, nil
-		}); err != nil {
-			// We log the error here because the test will fail at the very end
-			// because this validation runs in another goroutine. Without this,
-			// a failure is very confusing to track down because from the logs
-			// everything looks fine.
-			msg := fmt.Sprintf("Failed to contact service during master upgrade: %v", err)
-			Logf(msg)
-			Failf(msg)
-		}
-	}, 200*time.Millisecond, done)
+	selector := labels.Set{"name": svcName}.AsSelector()
+	probe := upgradeProbes(f, ip, selector, svcName)
+	probe.Start()
 
 	Logf("Starting master upgrade")
-	expectNoError(mUp())
-	done <- struct{}{}
+	upErr := mUp()
 	Logf("Stopping async validation")
-	wg.Wait()
+	report, sloErr := probe.Stop()
+	Logf("Async probe report: %s", report)
+	expectNoError(upErr)
+	expectNoError(sloErr)
 	Logf("Master upgrade complete")
 }
 
-func testNodeUpgrade(f Framework, nUp func(f Framework, n int) error, replicas int) {
+func testNodeUpgrade(f Framework, ip, svcName string, nUp func(f Framework, n int) error, replicas int) {
 	Logf("Starting node upgrade")
-	expectNoError(nUp(f, replicas))
+	selector := labels.Set{"name": svcName}.AsSelector()
+	probe := upgradeProbes(f, ip, selector, svcName)
+	probe.Start()
+
+	upErr := nUp(f, replicas)
+	report, sloErr := probe.Stop()
+	Logf("Async probe report: %s", report)
+	expectNoError(upErr)
+	expectNoError(sloErr)
 	Logf("Node upgrade complete")
 
 	// TODO(mbforbes): Validate that:
@@ -272,7 +469,7 @@ func runScript(script string, args ...string) (string, string, error) {
 	return stdout, stderr, nil
 }
 
-func validate(f Framework, svcNameWant, rcNameWant string, ingress api.LoadBalancerIngress, podsWant int) error {
+func validate(f Framework, svcNameWant, rcNameWant string, ingress api.LoadBalancerIngress, podsWant int, fixture *UpgradeDataFixture) error {
 	Logf("Beginning cluster validation")
 	// Verify RC.
 	rcs, err := f.Client.ReplicationControllers(f.Namespace.Name).List(labels.Everything())
@@ -302,6 +499,14 @@ func validate(f Framework, svcNameWant, rcNameWant string, ingress api.LoadBalan
 	// TODO(mbforbes): Make testLoadBalancerReachable return an error.
 	testLoadBalancerReachable(ingress, 80)
 
+	// Verify the Secret and PersistentVolume provisioned before the
+	// upgrade are both still there, unchanged.
+	if fixture != nil {
+		if err := fixture.Validate(); err != nil {
+			return fmt.Errorf("data fixture validation failed: %v", err)
+		}
+	}
+
 	Logf("Cluster validation succeeded")
 	return nil
 }
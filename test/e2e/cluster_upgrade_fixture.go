@@ -0,0 +1,230 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api/resource"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+
+	. "github.com/onsi/ginkgo"
+)
+
+// UpgradeDataFixture provisions a Secret and a PersistentVolumeClaim
+// bound to a GCE PD before an upgrade, so Validate can assert afterward
+// that each survived byte-for-byte. This turns the upgrade specs into
+// data-durability tests, not just reachability checks.
+//
+// The original request also asked for ConfigMap coverage, but
+// ConfigMap/Client.ConfigMaps()/ConfigMapVolumeSource don't exist in this
+// release's API (ConfigMap landed in Kubernetes 1.2; this tree predates
+// it) -- there's nothing to wire up here yet, so this fixture is
+// Secret+PVC only until the API actually has a ConfigMap to provision.
+type UpgradeDataFixture struct {
+	f Framework
+
+	secretName string
+	pvcName    string
+	rcName     string
+
+	secretData string
+	pvcData    string
+
+	diskName string
+}
+
+// NewUpgradeDataFixture returns a fixture scoped to f's namespace. Call
+// Setup before the upgrade under test and Validate after it.
+func NewUpgradeDataFixture(f Framework) *UpgradeDataFixture {
+	return &UpgradeDataFixture{
+		f:          f,
+		secretName: "upgrade-secret",
+		pvcName:    "upgrade-pvc",
+		rcName:     "upgrade-data-pod",
+		secretData: "secret-data-before-upgrade",
+		pvcData:    "pvc-data-before-upgrade",
+	}
+}
+
+// Setup creates the Secret and PVC, then a single-replica RC whose pod
+// mounts both, and checkpoints known data onto the PVC so Validate has
+// something to compare against. The pod is RC-managed, not a bare pod, so
+// it (and the PVC mount) comes back on whatever node it's rescheduled to
+// if an upgrade deletes it.
+func (u *UpgradeDataFixture) Setup() {
+	ns := u.f.Namespace.Name
+
+	By("Provisioning a Secret to carry through the upgrade")
+	_, err := u.f.Client.Secrets(ns).Create(&api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: u.secretName},
+		Data:       map[string][]byte{"data": []byte(u.secretData)},
+	})
+	expectNoError(err)
+
+	By("Provisioning a PersistentVolumeClaim bound to a GCE PD")
+	_, err = u.f.Client.PersistentVolumeClaims(ns).Create(&api.PersistentVolumeClaim{
+		ObjectMeta: api.ObjectMeta{Name: u.pvcName},
+		Spec: api.PersistentVolumeClaimSpec{
+			AccessModes: []api.PersistentVolumeAccessMode{api.ReadWriteOnce},
+			Resources: api.ResourceRequirements{
+				Requests: api.ResourceList{api.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		},
+	})
+	expectNoError(err)
+	expectNoError(waitForPVCBound(u.f.Client, ns, u.pvcName, pvClaimBindTimeout))
+
+	pvc, err := u.f.Client.PersistentVolumeClaims(ns).Get(u.pvcName)
+	expectNoError(err)
+	pv, err := u.f.Client.PersistentVolumes().Get(pvc.Spec.VolumeName)
+	expectNoError(err)
+	if pv.Spec.GCEPersistentDisk != nil {
+		u.diskName = pv.Spec.GCEPersistentDisk.PDName
+	}
+
+	By("Creating an RC whose pod mounts the Secret and PVC")
+	_, err = u.f.Client.ReplicationControllers(ns).Create(upgradeDataFixtureRC(u.rcName, u.secretName, u.pvcName))
+	expectNoError(err)
+	expectNoError(waitForPodsRunningReady(ns, 1, restartPodReadyAgainTimeout))
+
+	podName, err := findRunningPod(u.f, u.selector())
+	expectNoError(err)
+
+	By("Checkpointing data onto the PersistentVolumeClaim")
+	_, err = runKubectl("exec", podName, fmt.Sprintf("--namespace=%s", ns), "--", "sh", "-c",
+		fmt.Sprintf("echo -n %s > /checkpoint/pvc", u.pvcData))
+	expectNoError(err)
+}
+
+// Validate asserts that the Secret is byte-identical to what Setup wrote,
+// that the PersistentVolumeClaim is still Bound to the same underlying
+// disk, and that the data Setup checkpointed onto it is still readable
+// via kubectl exec -- from whatever pod currently has it mounted, since
+// an upgrade may have rescheduled the original one.
+func (u *UpgradeDataFixture) Validate() error {
+	ns := u.f.Namespace.Name
+
+	secret, err := u.f.Client.Secrets(ns).Get(u.secretName)
+	if err != nil {
+		return fmt.Errorf("error getting secret %s: %v", u.secretName, err)
+	}
+	if got := string(secret.Data["data"]); got != u.secretData {
+		return fmt.Errorf("secret %s data changed across upgrade: wanted %q, got %q", u.secretName, u.secretData, got)
+	}
+
+	pvc, err := u.f.Client.PersistentVolumeClaims(ns).Get(u.pvcName)
+	if err != nil {
+		return fmt.Errorf("error getting pvc %s: %v", u.pvcName, err)
+	}
+	if pvc.Status.Phase != api.ClaimBound {
+		return fmt.Errorf("pvc %s is %s after upgrade, not Bound", u.pvcName, pvc.Status.Phase)
+	}
+	pv, err := u.f.Client.PersistentVolumes().Get(pvc.Spec.VolumeName)
+	if err != nil {
+		return fmt.Errorf("error getting pv %s: %v", pvc.Spec.VolumeName, err)
+	}
+	if pv.Status.Phase != api.VolumeBound {
+		return fmt.Errorf("pv %s is %s after upgrade, not Bound", pv.Name, pv.Status.Phase)
+	}
+	if pv.Spec.GCEPersistentDisk == nil || pv.Spec.GCEPersistentDisk.PDName != u.diskName {
+		return fmt.Errorf("pv %s no longer points at disk %s after upgrade", pv.Name, u.diskName)
+	}
+
+	podName, err := findRunningPod(u.f, u.selector())
+	if err != nil {
+		return fmt.Errorf("no running pod found to read back checkpointed PVC data: %v", err)
+	}
+	out, err := runKubectl("exec", podName, fmt.Sprintf("--namespace=%s", ns), "--", "cat", "/checkpoint/pvc")
+	if err != nil {
+		return fmt.Errorf("error reading back checkpointed PVC data: %v", err)
+	}
+	if got := strings.TrimSpace(out); got != u.pvcData {
+		return fmt.Errorf("checkpointed PVC data changed across upgrade: wanted %q, got %q", u.pvcData, got)
+	}
+
+	return nil
+}
+
+// Cleanup removes everything Setup created. Framework's own namespace
+// teardown would eventually catch these, but the PV's backing GCE PD
+// outlives the namespace unless the PVC is deleted first.
+func (u *UpgradeDataFixture) Cleanup() {
+	ns := u.f.Namespace.Name
+	if err := u.f.Client.ReplicationControllers(ns).Delete(u.rcName); err != nil {
+		Logf("Error cleaning up upgrade fixture RC %s: %v", u.rcName, err)
+	}
+	pods, err := u.f.Client.Pods(ns).List(u.selector(), nil)
+	if err != nil {
+		Logf("Error listing upgrade fixture pods for cleanup: %v", err)
+	}
+	for _, pod := range pods.Items {
+		if err := u.f.Client.Pods(ns).Delete(pod.Name); err != nil {
+			Logf("Error cleaning up upgrade fixture pod %s: %v", pod.Name, err)
+		}
+	}
+	if err := u.f.Client.PersistentVolumeClaims(ns).Delete(u.pvcName); err != nil {
+		Logf("Error cleaning up upgrade fixture pvc %s: %v", u.pvcName, err)
+	}
+	if err := u.f.Client.Secrets(ns).Delete(u.secretName); err != nil {
+		Logf("Error cleaning up upgrade fixture secret %s: %v", u.secretName, err)
+	}
+}
+
+// selector matches the pod created by Setup's RC, however many times it's
+// been rescheduled.
+func (u *UpgradeDataFixture) selector() labels.Selector {
+	return labels.Set{"name": u.rcName}.AsSelector()
+}
+
+// upgradeDataFixtureRC builds the single-replica RC Setup uses to
+// checkpoint and later read back data from the Secret and PVC. It's
+// RC-managed rather than a bare pod so the PVC mount comes back if an
+// upgrade deletes the pod out from under it.
+func upgradeDataFixtureRC(name, secretName, pvcName string) *api.ReplicationController {
+	labels := map[string]string{"name": name}
+	return &api.ReplicationController{
+		ObjectMeta: api.ObjectMeta{Name: name},
+		Spec: api.ReplicationControllerSpec{
+			Replicas: 1,
+			Selector: labels,
+			Template: &api.PodTemplateSpec{
+				ObjectMeta: api.ObjectMeta{Labels: labels},
+				Spec: api.PodSpec{
+					Containers: []api.Container{
+						{
+							Name:    "holder",
+							Image:   "gcr.io/google_containers/busybox",
+							Command: []string{"sh", "-c", "while true; do sleep 3600; done"},
+							VolumeMounts: []api.VolumeMount{
+								{Name: "secret", MountPath: "/secret"},
+								{Name: "pvc", MountPath: "/checkpoint"},
+							},
+						},
+					},
+					Volumes: []api.Volume{
+						{Name: "secret", VolumeSource: api.VolumeSource{Secret: &api.SecretVolumeSource{SecretName: secretName}}},
+						{Name: "pvc", VolumeSource: api.VolumeSource{PersistentVolumeClaim: &api.PersistentVolumeClaimVolumeSource{ClaimName: pvcName}}},
+					},
+					RestartPolicy: api.RestartPolicyAlways,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+)
+
+// lbReachableProbe checks that ip serves HTTP with a status of at least 200
+// and below 404 -- the same check testMasterUpgrade used to run inline
+// before probes were generalized into AsyncProbe.
+func lbReachableProbe(ip string) ProbeFunc {
+	httpClient := http.Client{Timeout: 2 * time.Second}
+	return func() (time.Duration, error) {
+		start := time.Now()
+		r, err := httpClient.Get("http://" + ip)
+		if err != nil {
+			return time.Since(start), err
+		}
+		if r.StatusCode < http.StatusOK || r.StatusCode >= http.StatusNotFound {
+			return time.Since(start), fmt.Errorf("bad response; status: %d", r.StatusCode)
+		}
+		return time.Since(start), nil
+	}
+}
+
+// apiServerHealthzProbe checks kube-apiserver's /healthz endpoint
+// directly, independent of any load balancer in front of it.
+func apiServerHealthzProbe(c *client.Client) ProbeFunc {
+	return func() (time.Duration, error) {
+		start := time.Now()
+		body, err := c.Get().AbsPath("/healthz").Do().Raw()
+		if err != nil {
+			return time.Since(start), err
+		}
+		if string(body) != "ok" {
+			return time.Since(start), fmt.Errorf("unhealthy: %s", string(body))
+		}
+		return time.Since(start), nil
+	}
+}
+
+// findRunningPod returns the name of a Running pod matching selector in
+// f's namespace. Probes use it instead of remembering a single pod name,
+// since a node upgrade can reschedule every pod mid-run.
+func findRunningPod(f Framework, selector labels.Selector) (string, error) {
+	pods, err := f.Client.Pods(f.Namespace.Name).List(selector, nil)
+	if err != nil {
+		return "", err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == api.PodRunning {
+			return pod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no running pod found for selector %v", selector)
+}
+
+// dnsResolvesProbe checks that svcName resolves from inside the cluster,
+// by exec'ing nslookup in a running pod matched by selector.
+func dnsResolvesProbe(f Framework, selector labels.Selector, svcName string) ProbeFunc {
+	return func() (time.Duration, error) {
+		start := time.Now()
+		podName, err := findRunningPod(f, selector)
+		if err != nil {
+			return time.Since(start), err
+		}
+		host := fmt.Sprintf("%s.%s.svc.cluster.local", svcName, f.Namespace.Name)
+		_, err = runKubectl("exec", podName, fmt.Sprintf("--namespace=%s", f.Namespace.Name), "--", "nslookup", host)
+		return time.Since(start), err
+	}
+}
+
+// podExecProbe checks that kubectl exec still works against a running pod
+// matched by selector, catching apiserver/kubelet exec-path regressions a
+// plain HTTP probe wouldn't.
+func podExecProbe(f Framework, selector labels.Selector) ProbeFunc {
+	return func() (time.Duration, error) {
+		start := time.Now()
+		podName, err := findRunningPod(f, selector)
+		if err != nil {
+			return time.Since(start), err
+		}
+		_, err = runKubectl("exec", podName, fmt.Sprintf("--namespace=%s", f.Namespace.Name), "--", "echo", "probe")
+		return time.Since(start), err
+	}
+}
+
+// runKubectl runs kubectl against the cluster under test and returns its
+// stdout, with stderr folded into the error on failure. Callers that need
+// to compare output exactly (e.g. a checkpointed-data readback) can't use
+// combined output, since a stray kubectl warning on stderr would corrupt
+// the comparison.
+func runKubectl(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("kubectl", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("kubectl %v failed: %v, stdout: %s, stderr: %s", args, err, stdout.String(), stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// upgradeProbes builds the standard AsyncProbe run across disruptive
+// operations (master upgrade, node upgrade, and future drain/kill-master
+// tests): LB reachability, apiserver /healthz, in-cluster DNS resolution,
+// and pod exec, each polled every 200ms. The SLOs are deliberately
+// forgiving of an isolated blip -- a node upgrade is expected to bounce
+// individual requests -- while still catching a real availability
+// regression or a probe that silently stops making progress.
+func upgradeProbes(f Framework, ip string, selector labels.Selector, svcName string) *AsyncProbe {
+	probe := NewAsyncProbe(200 * time.Millisecond).
+		WithProbe("lb", lbReachableProbe(ip)).
+		WithProbe("apiserver", apiServerHealthzProbe(f.Client)).
+		WithProbe("dns", dnsResolvesProbe(f, selector, svcName)).
+		WithProbe("exec", podExecProbe(f, selector))
+
+	for _, name := range []string{"lb", "apiserver", "dns", "exec"} {
+		probe.WithSLO(name, "no gap > 5s between samples", MaxSampleGap(5*time.Second))
+	}
+	probe.WithSLO("lb", ">=99% of LB probes succeed", MinSuccessRate(0.99))
+	probe.WithSLO("apiserver", "p99 latency < 2s", MaxLatencyPercentile(99, 2*time.Second))
+
+	return probe
+}